@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// issueCacheDir returns the scratch directory a single issue's encrypted
+// pages are cached under while it downloads, e.g.
+// "<magazine>/.cache/<issueID>".
+func issueCacheDir(magazineDir, issueID string) string {
+	return filepath.Join(magazineDir, ".cache", issueID)
+}
+
+// pageCachePath returns the cache file for page i (zero-indexed) within
+// cacheDir.
+func pageCachePath(cacheDir string, i int) string {
+	return filepath.Join(cacheDir, fmt.Sprintf("page-%03d.pdf.enc", i+1))
+}
+
+// cachedPageValid reports whether the page cached at path is already
+// complete, by comparing its size against the Content-Length of a HEAD
+// request to url. A missing or unverifiable cache file is not an error; nor
+// is a failed or non-200 HEAD request, since that's exactly the kind of
+// transient failure downloadPage's retry loop exists to ride out. Either
+// case just means the page needs (re-)downloading.
+func cachedPageValid(ctx context.Context, client *http.Client, url, path string) bool {
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return false
+	}
+
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+
+	if err != nil {
+		return false
+	}
+
+	resp, err := ctxhttp.Do(ctx, client, req)
+
+	if err != nil {
+		return false
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+
+	return resp.ContentLength > 0 && info.Size() == resp.ContentLength
+}
+
+// openCachedPage opens an already-downloaded page cache file for reading.
+func openCachedPage(path string) (page, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return page{}, err
+	}
+
+	return page{ReadSeeker: f, close: f.Close}, nil
+}
+
+// writeCachedPage atomically writes p to path and reopens it from disk, so
+// the in-memory copy can be released once the page is downloaded.
+func writeCachedPage(path string, p page) (page, error) {
+	if err := writeAtomic(path, func(w io.WriteSeeker) error {
+		_, err := io.Copy(w, p.ReadSeeker)
+		return err
+	}); err != nil {
+		return page{}, err
+	}
+
+	return openCachedPage(path)
+}
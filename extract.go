@@ -0,0 +1,253 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/unidoc/unidoc/pdf"
+)
+
+// OutputFormat selects how a downloaded issue's pages are written to disk.
+type OutputFormat string
+
+const (
+	FormatPDF    OutputFormat = "pdf"
+	FormatCBZ    OutputFormat = "cbz"
+	FormatImages OutputFormat = "images"
+)
+
+// Ext returns the file extension used for an issue saved in this format,
+// or "" for FormatImages, which writes into a directory instead of a file.
+func (f OutputFormat) Ext() string {
+	switch f {
+	case FormatCBZ:
+		return ".cbz"
+	case FormatImages:
+		return ""
+	default:
+		return ".pdf"
+	}
+}
+
+// PageExtractor decrypts a set of downloaded pages with the issue password
+// and writes them to destPath. pdfExtractor, cbzExtractor and
+// imagesExtractor all share decryptPages so the password handling only
+// lives in one place.
+type PageExtractor interface {
+	Extract(pages []page, password string, destPath string) error
+}
+
+// ExtractorFor returns the PageExtractor for the given output format.
+func ExtractorFor(format OutputFormat) (PageExtractor, error) {
+	switch format {
+	case "", FormatPDF:
+		return pdfExtractor{}, nil
+	case FormatCBZ:
+		return cbzExtractor{}, nil
+	case FormatImages:
+		return imagesExtractor{}, nil
+	default:
+		return nil, errors.Errorf("unknown output format %q", format)
+	}
+}
+
+// decryptedPage is a single page, unlocked with the issue password and
+// parsed into a pdf.PdfPage.
+type decryptedPage struct {
+	pdfPage *pdf.PdfPage
+}
+
+// decryptPages unlocks every page with password. This is the same
+// decrypt-and-parse step unlockAndMerge used to perform inline, now shared
+// by every PageExtractor.
+func decryptPages(pages []page, password []byte) ([]decryptedPage, error) {
+	var decrypted []decryptedPage
+
+	for _, p := range pages {
+		defer p.Close()
+
+		r, err := pdf.NewPdfReader(p)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ok, err := r.Decrypt(password)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			return nil, errors.Errorf("failed to decrypt pages using password %s", string(password))
+		}
+
+		numPages, err := r.GetNumPages()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for i := 0; i < numPages; i++ {
+			pdfPage, err := r.GetPageAsPdfPage(i + 1)
+
+			if err != nil {
+				return nil, err
+			}
+
+			pdfPage.Annots = nil
+			decrypted = append(decrypted, decryptedPage{pdfPage})
+		}
+	}
+
+	return decrypted, nil
+}
+
+// pageImage returns the raw bytes of the image embedded in p, since the
+// page blobs Zinio serves are single-image PDFs with a DCTDecode (JPEG)
+// XObject, so the stream's raw bytes are already a valid JPEG and need no
+// further decoding.
+func pageImage(p decryptedPage) ([]byte, error) {
+	xobjects, ok := pdf.TraceToDirectObject(p.pdfPage.Resources.XObject).(*pdf.PdfObjectDictionary)
+
+	if !ok {
+		return nil, errors.New("page has no embedded image")
+	}
+
+	for _, obj := range *xobjects {
+		stream, ok := pdf.TraceToDirectObject(obj).(*pdf.PdfObjectStream)
+
+		if !ok {
+			continue
+		}
+
+		return stream.Stream, nil
+	}
+
+	return nil, errors.New("page has no embedded image")
+}
+
+// writeAtomic writes to a ".part" file next to destPath and renames it into
+// place once write succeeds. write
+// takes an io.WriteSeeker, since pdf.PdfWriter.Write needs to seek back to
+// patch up the xref table; the temp file satisfies both.
+func writeAtomic(destPath string, write func(io.WriteSeeker) error) error {
+	temp := destPath + ".part"
+	file, err := os.Create(temp)
+
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", destPath)
+	}
+
+	err = write(file)
+	cerr := file.Close()
+
+	if err != nil || cerr != nil {
+		return errors.Wrapf(err, "failed to save %s", destPath)
+	}
+
+	return errors.Wrapf(os.Rename(temp, destPath), "failed to save %s", destPath)
+}
+
+// pdfExtractor merges every page into a single PDF, the original behavior.
+type pdfExtractor struct{}
+
+func (pdfExtractor) Extract(pages []page, password string, destPath string) error {
+	decrypted, err := decryptPages(pages, []byte(password))
+
+	if err != nil {
+		return errors.Wrapf(err, "failed to unlock and merge pages for %s", destPath)
+	}
+
+	w := pdf.NewPdfWriter()
+
+	for _, d := range decrypted {
+		if err := w.AddPage(d.pdfPage.GetPageAsIndirectObject()); err != nil {
+			return err
+		}
+	}
+
+	return writeAtomic(destPath, w.Write)
+}
+
+// cbzExtractor writes each page's image into a zero-padded entry of a
+// zip-format CBZ archive.
+type cbzExtractor struct{}
+
+func (cbzExtractor) Extract(pages []page, password string, destPath string) error {
+	decrypted, err := decryptPages(pages, []byte(password))
+
+	if err != nil {
+		return errors.Wrapf(err, "failed to unlock pages for %s", destPath)
+	}
+
+	return writeAtomic(destPath, func(w io.WriteSeeker) error {
+		zw := zip.NewWriter(w)
+
+		for i, d := range decrypted {
+			img, err := pageImage(d)
+
+			if err != nil {
+				return errors.Wrapf(err, "failed to extract page %d", i+1)
+			}
+
+			entry, err := zw.Create(fmt.Sprintf("page-%03d.jpg", i+1))
+
+			if err != nil {
+				return err
+			}
+
+			if _, err := entry.Write(img); err != nil {
+				return err
+			}
+		}
+
+		return zw.Close()
+	})
+}
+
+// imagesExtractor writes each page's image as its own file into destPath.
+type imagesExtractor struct{}
+
+func (imagesExtractor) Extract(pages []page, password string, destPath string) error {
+	decrypted, err := decryptPages(pages, []byte(password))
+
+	if err != nil {
+		return errors.Wrapf(err, "failed to unlock pages for %s", destPath)
+	}
+
+	// Pages are written into a ".part" directory and renamed into place as
+	// a whole once every page succeeds, the same atomicity writeAtomic
+	// gives pdfExtractor and cbzExtractor. Writing straight into destPath
+	// would leave a partial page set behind on a mid-extraction failure,
+	// which downloadAllIssues would then mistake for a completed download.
+	temp := destPath + ".part"
+
+	if err := os.RemoveAll(temp); err != nil {
+		return errors.Wrapf(err, "failed to clear %s", temp)
+	}
+
+	if err := os.MkdirAll(temp, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create %s", temp)
+	}
+
+	for i, d := range decrypted {
+		img, err := pageImage(d)
+
+		if err != nil {
+			return errors.Wrapf(err, "failed to extract page %d", i+1)
+		}
+
+		name := filepath.Join(temp, fmt.Sprintf("page-%03d.jpg", i+1))
+
+		if err := os.WriteFile(name, img, 0644); err != nil {
+			return errors.Wrapf(err, "failed to write %s", name)
+		}
+	}
+
+	return errors.Wrapf(os.Rename(temp, destPath), "failed to save %s", destPath)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+// globList is a flag.Value collecting every occurrence of a repeated
+// -tag/-notag flag into a slice of glob patterns.
+type globList []string
+
+func (g *globList) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *globList) Set(v string) error {
+	*g = append(*g, v)
+	return nil
+}
+
+// Filters narrows the set of issues downloadAllIssues schedules work for.
+// The zero value matches everything.
+type Filters struct {
+	Magazine string
+	Issue    string
+	Tags     []string
+	NoTags   []string
+	Since    time.Time
+	Limit    int
+	DryRun   bool
+}
+
+// matches reports whether an issue belonging to magazineTitle and titled
+// issueTitle should be downloaded, ignoring Since and Limit.
+func (f Filters) matches(magazineTitle, issueTitle string) bool {
+	if f.Magazine != "" && !globMatch(f.Magazine, magazineTitle) {
+		return false
+	}
+
+	if f.Issue != "" && !globMatch(f.Issue, issueTitle) {
+		return false
+	}
+
+	if len(f.Tags) > 0 && !anyGlobMatch(f.Tags, magazineTitle, issueTitle) {
+		return false
+	}
+
+	if anyGlobMatch(f.NoTags, magazineTitle, issueTitle) {
+		return false
+	}
+
+	return true
+}
+
+// since reports whether publishedAt satisfies the -since cutoff.
+func (f Filters) since(publishedAt time.Time) bool {
+	return f.Since.IsZero() || !publishedAt.Before(f.Since)
+}
+
+func anyGlobMatch(patterns []string, candidates ...string) bool {
+	for _, pattern := range patterns {
+		for _, candidate := range candidates {
+			if globMatch(pattern, candidate) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// globMatch matches pattern against s case-insensitively, supporting the
+// same wildcards as path.Match.
+func globMatch(pattern, s string) bool {
+	ok, err := path.Match(strings.ToLower(pattern), strings.ToLower(s))
+	return err == nil && ok
+}
@@ -0,0 +1,21 @@
+package main
+
+import "fmt"
+
+// Issue is the full metadata for a single issue, including the URL of each
+// page and the password needed to unlock them once downloaded.
+type Issue struct {
+	ID        string
+	PageCount int
+	Password  string
+	PageURLs  []string `json:"pageURLs"`
+}
+
+// GetURL returns the URL of page i (zero-indexed) of the issue.
+func (i *Issue) GetURL(page int) (string, error) {
+	if page < 0 || page >= len(i.PageURLs) {
+		return "", fmt.Errorf("page %d out of range for issue with %d pages", page, len(i.PageURLs))
+	}
+
+	return i.PageURLs[page], nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import "time"
+
+// Magazine describes a single subscription title in the account's library.
+type Magazine struct {
+	ID     string
+	Title  string
+	Issues []IssueMeta
+}
+
+// IssueMeta is the lightweight issue summary returned alongside a Magazine,
+// before the full Issue (with page URLs) has been fetched.
+type IssueMeta struct {
+	ID          string
+	Title       string
+	PublishedAt time.Time
+}
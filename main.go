@@ -4,18 +4,20 @@ import (
 	"bytes"
 	"context"
 	"flag"
+	"net"
 	"regexp"
 	"strings"
 
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"time"
 
 	"github.com/pkg/errors"
-	"github.com/unidoc/unidoc/pdf"
 	"golang.org/x/net/context/ctxhttp"
+	"golang.org/x/sync/errgroup"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -25,6 +27,18 @@ var (
 	whiteSpaces  = regexp.MustCompile("\\s+")
 )
 
+const (
+	defaultConcurrency = 4
+	maxPageAttempts    = 3
+	retryBaseDelay     = 1 * time.Second
+)
+
+// retryableError marks a downloadPage failure as worth retrying, as opposed
+// to a permanent error (bad URL, auth failure, ...).
+type retryableError struct {
+	error
+}
+
 func sanitize(name string) string {
 	r := strings.NewReplacer("/", " - ", ":", " - ")
 	s := r.Replace(name)
@@ -36,17 +50,26 @@ func sanitize(name string) string {
 	return s
 }
 
-func downloadPage(ctx context.Context, url string) (page, error) {
+func fetchPage(ctx context.Context, client *http.Client, url string) (page, error) {
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	resp, err := ctxhttp.Get(ctx, http.DefaultClient, url)
+	resp, err := ctxhttp.Get(ctx, client, url)
 
 	if err != nil {
+		if ne, ok := err.(net.Error); ok && (ne.Timeout() || ne.Temporary()) {
+			return page{}, retryableError{err}
+		}
+
 		return page{}, err
 	}
 
 	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return page{}, retryableError{errors.Errorf("server returned %s", resp.Status)}
+	}
+
 	b, err := ioutil.ReadAll(resp.Body)
 
 	if err != nil {
@@ -54,170 +77,306 @@ func downloadPage(ctx context.Context, url string) (page, error) {
 	}
 
 	r := bytes.NewReader(b)
-	return page{r}, nil
+	return page{ReadSeeker: r}, nil
 }
 
-func downloadAllPages(ctx context.Context, issue *Issue) ([]page, error) {
-	var pages []page
+// downloadPage fetches a single page, retrying transient failures (5xx
+// responses, timeouts) a fixed number of times with capped exponential
+// backoff before giving up. If cachePath is non-empty and already holds
+// the full page (checked against the remote Content-Length), the download
+// is skipped entirely and the cache file is reopened instead; otherwise
+// the freshly downloaded page is written to cachePath before being handed
+// back, so a later run can resume from it.
+func downloadPage(ctx context.Context, client *http.Client, url, cachePath string) (page, error) {
+	if cachePath != "" && cachedPageValid(ctx, client, url, cachePath) {
+		return openCachedPage(cachePath)
+	}
 
-	for i := 0; i < issue.PageCount; i++ {
-		url, err := issue.GetURL(i)
+	var lastErr error
 
-		if err != nil {
-			return nil, err
+	for attempt := 0; attempt < maxPageAttempts; attempt++ {
+		if attempt > 0 {
+			delay := retryBaseDelay << uint(attempt-1)
+
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return page{}, ctx.Err()
+			}
 		}
 
-		page, err := downloadPage(ctx, url)
+		p, err := fetchPage(ctx, client, url)
 
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to download page %d", i)
+		if err == nil {
+			if cachePath == "" {
+				return p, nil
+			}
+
+			return writeCachedPage(cachePath, p)
 		}
 
-		pages = append(pages, page)
-	}
+		if _, retryable := err.(retryableError); !retryable {
+			return page{}, err
+		}
 
-	if len(pages) > 0 {
-		pages = append(pages[1:], pages[0])
+		lastErr = err
 	}
 
-	return pages, nil
+	return page{}, errors.Wrapf(lastErr, "giving up after %d attempts", maxPageAttempts)
 }
 
-func downloadAllIssues(ctx context.Context, session *Session, magazines []Magazine) error {
-	for _, magazine := range magazines {
-		dir := sanitize(magazine.Title)
-
-		if _, err := os.Stat(dir); os.IsNotExist(err) {
-			if err := os.Mkdir(dir, 0755); err != nil {
-				log.Error(errors.Wrapf(err, "failed to create directory %s", magazine.Title))
-				continue
-			}
+// downloadAllPages fetches every page of issue concurrently, drawing from
+// sem so the number of in-flight requests stays within the -concurrency
+// limit shared with downloadAllIssues. Pages are written into a fixed-size
+// slice indexed by page number so ordering survives the concurrent fetch,
+// then rotated the same way the sequential version did. If cacheDir is
+// non-empty, each page is cached under it so an interrupted download can
+// resume without re-fetching pages it already has.
+func downloadAllPages(ctx context.Context, client *http.Client, issue *Issue, sem chan struct{}, cacheDir string) ([]page, error) {
+	if cacheDir != "" {
+		if err := os.MkdirAll(cacheDir, 0755); err != nil {
+			return nil, errors.Wrapf(err, "failed to create page cache %s", cacheDir)
 		}
+	}
 
-		for _, metadata := range magazine.Issues {
-			file := sanitize(metadata.Title)
-			path := path.Join(dir, file+".pdf")
+	pages := make([]page, issue.PageCount)
 
-			entry := log.WithFields(log.Fields{
-				"magazine": magazine.Title,
-				"issue":    metadata.Title,
-			})
+	g, ctx := errgroup.WithContext(ctx)
 
-			if _, err := os.Stat(path); err == nil {
-				entry.Info("issue already downloaded")
-				continue
-			}
+	for i := 0; i < issue.PageCount; i++ {
+		i := i
 
-			err := func() error {
-				entry.Info("downloading issue metadata")
-				issue, err := session.GetIssue(ctx, magazine.ID, metadata.ID)
+		url, err := issue.GetURL(i)
 
-				if err != nil {
-					return err
-				}
+		if err != nil {
+			return nil, err
+		}
 
-				entry.Info("downloading issue")
-				pages, err := downloadAllPages(ctx, issue)
+		var cachePath string
 
-				if err != nil {
-					return errors.Wrapf(err, "failed to download %s %s", magazine.Title, metadata.Title)
-				}
+		if cacheDir != "" {
+			cachePath = pageCachePath(cacheDir, i)
+		}
 
-				entry.Info("saving issue")
-				err = save(session, pages, issue.Password, path)
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			err := g.Wait()
+			closePages(pages)
 
-				if err != nil {
-					return err
-				}
+			if err == nil {
+				err = ctx.Err()
+			}
 
-				return nil
-			}()
+			return nil, err
+		}
+
+		g.Go(func() error {
+			defer func() { <-sem }()
+
+			p, err := downloadPage(ctx, client, url, cachePath)
 
 			if err != nil {
-				log.Error(err)
+				return errors.Wrapf(err, "failed to download page %d", i)
 			}
-		}
-	}
 
-	return nil
-}
+			pages[i] = p
+			return nil
+		})
+	}
 
-func save(session *Session, pages []page, password string, path string) error {
-	pdf, err := unlockAndMerge(pages, []byte(password))
+	if err := g.Wait(); err != nil {
+		closePages(pages)
+		return nil, err
+	}
 
-	if err != nil {
-		return errors.Wrapf(err, "failed to unlock and merge pages for %s", path)
+	if len(pages) > 0 {
+		pages = append(pages[1:], pages[0])
 	}
 
-	temp := path + ".part"
-	file, err := os.Create(temp)
+	return pages, nil
+}
 
-	if err != nil {
-		return errors.Wrapf(err, "failed to create %s", path)
+// closePages closes every page in pages, ignoring any that are still their
+// zero value (not yet fetched). It is used to release the open cache file
+// handles a partially-filled pages slice is left holding when
+// downloadAllPages gives up on an issue before decryptPages gets a chance
+// to close them itself.
+func closePages(pages []page) {
+	for _, p := range pages {
+		p.Close()
 	}
+}
+
+// issueJob is a single issue matched by filters and queued for download.
+type issueJob struct {
+	magazine Magazine
+	metadata IssueMeta
+	path     string
+}
+
+// planIssues applies filters to every issue in magazines, in order, and
+// returns the jobs that should be downloaded. Each job's path is given the
+// extension (or, for FormatImages, no extension) matching format.
+func planIssues(magazines []Magazine, filters Filters, format OutputFormat) []issueJob {
+	var jobs []issueJob
+
+	for _, magazine := range magazines {
+		dir := sanitize(magazine.Title)
 
-	err = pdf.Write(file)
-	cerr := file.Close()
+		for _, metadata := range magazine.Issues {
+			if !filters.matches(magazine.Title, metadata.Title) || !filters.since(metadata.PublishedAt) {
+				continue
+			}
+
+			file := sanitize(metadata.Title)
+			jobs = append(jobs, issueJob{magazine, metadata, path.Join(dir, file+format.Ext())})
+		}
+	}
 
-	if err != nil || cerr != nil {
-		return errors.Wrapf(err, "failed to save %s", path)
+	if filters.Limit > 0 && len(jobs) > filters.Limit {
+		jobs = jobs[:filters.Limit]
 	}
 
-	return errors.Wrapf(os.Rename(temp, path), "failed to save %s", path)
+	return jobs
 }
 
-func unlockAndMerge(pages []page, password []byte) (*pdf.PdfWriter, error) {
-	w := pdf.NewPdfWriter()
+// downloadAllIssues downloads every issue matched by filters. A single
+// semaphore of size concurrency is shared between issue metadata fetches
+// and downloadAllPages's page fetches, so the total number of in-flight
+// HTTP requests across both levels stays at concurrency, matching the
+// -concurrency flag's documented meaning; an issue goroutine releases its
+// slot as soon as its metadata fetch completes, before its pages start
+// drawing from the same semaphore, so the two levels never deadlock each
+// other. Each issue is then handed to the PageExtractor for format. A
+// single issue failing is logged and does not stop the others; cancelling
+// ctx stops everything in flight. In dry-run mode, nothing is fetched:
+// each matched issue and its destination path are logged instead.
+func downloadAllIssues(ctx context.Context, session *Session, magazines []Magazine, concurrency int, filters Filters, format OutputFormat) error {
+	extractor, err := ExtractorFor(format)
 
-	for _, page := range pages {
-		r, err := pdf.NewPdfReader(page)
+	if err != nil {
+		return err
+	}
 
-		if err != nil {
-			return nil, err
-		}
+	g, ctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, concurrency)
 
-		ok, err := r.Decrypt(password)
+	for _, job := range planIssues(magazines, filters, format) {
+		job := job
 
-		if err != nil {
-			return nil, err
+		entry := log.WithFields(log.Fields{
+			"magazine": job.magazine.Title,
+			"issue":    job.metadata.Title,
+		})
+
+		if _, err := os.Stat(job.path); err == nil {
+			entry.Info("issue already downloaded")
+			continue
 		}
 
-		if !ok {
-			return nil, errors.Errorf("failed to decrypt pages using password %s", string(password))
+		if filters.DryRun {
+			entry.WithField("path", job.path).Info("dry run: would download issue")
+			continue
 		}
 
-		numPages, err := r.GetNumPages()
+		dir := sanitize(job.magazine.Title)
 
-		if err != nil {
-			return nil, err
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			if err := os.Mkdir(dir, 0755); err != nil {
+				entry.Error(errors.Wrapf(err, "failed to create directory %s", job.magazine.Title))
+				continue
+			}
 		}
 
-		for i := 0; i < numPages; i++ {
-			page, err := r.GetPageAsPdfPage(i + 1)
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return g.Wait()
+		}
+
+		g.Go(func() error {
+			entry.Info("downloading issue metadata")
+			issue, err := session.GetIssue(ctx, job.magazine.ID, job.metadata.ID)
+
+			// Release the slot used for the metadata fetch now, rather
+			// than holding it for the whole function: downloadAllPages
+			// draws from this same semaphore, and a goroutine can't wait
+			// on a slot it's still holding.
+			<-sem
+
+			if err != nil {
+				entry.Error(err)
+				return nil
+			}
+
+			cacheDir := issueCacheDir(dir, job.metadata.ID)
+
+			entry.Info("downloading issue")
+			pages, err := downloadAllPages(ctx, session.config.Client, issue, sem, cacheDir)
 
 			if err != nil {
-				return nil, err
+				entry.Error(errors.Wrapf(err, "failed to download %s %s", job.magazine.Title, job.metadata.Title))
+				return nil
 			}
 
-			page.Annots = nil
+			entry.Info("saving issue")
+			if err := extractor.Extract(pages, issue.Password, job.path); err != nil {
+				entry.Error(err)
+				return nil
+			}
 
-			if err = w.AddPage(page.GetPageAsIndirectObject()); err != nil {
-				return nil, err
+			if err := os.RemoveAll(cacheDir); err != nil {
+				entry.Error(errors.Wrapf(err, "failed to remove page cache %s", cacheDir))
 			}
-		}
+
+			return nil
+		})
 	}
 
-	return &w, nil
+	return g.Wait()
 }
 
 func main() {
-	var login, password string
+	var login, password, apiHost, magazine, issue, since, outputFormat, sessionFile string
+	var concurrency, limit int
+	var dryRun, logout bool
+	var tags, noTags globList
 
 	flag.StringVar(&login, "email", "", "Account email")
 	flag.StringVar(&password, "password", "", "Account password")
+	flag.StringVar(&apiHost, "api-host", "", "Zinio API host (defaults to $ZINIO_API_HOST, then "+defaultAPIHost+")")
+	flag.IntVar(&concurrency, "concurrency", defaultConcurrency, "Number of issues/pages to download in parallel")
+	flag.StringVar(&magazine, "magazine", "", "Only download magazines whose title matches this glob (case-insensitive)")
+	flag.StringVar(&issue, "issue", "", "Only download issues whose title matches this glob (case-insensitive)")
+	flag.Var(&tags, "tag", "Only download issues whose magazine or issue title matches this glob; repeatable")
+	flag.Var(&noTags, "notag", "Skip issues whose magazine or issue title matches this glob; repeatable")
+	flag.StringVar(&since, "since", "", "Only download issues published on or after this date (YYYY-MM-DD)")
+	flag.IntVar(&limit, "limit", 0, "Download at most this many issues (0 for no limit)")
+	flag.BoolVar(&dryRun, "dry-run", false, "Log what would be downloaded and where, without fetching anything")
+	flag.StringVar(&outputFormat, "output-format", string(FormatPDF), "Output format: pdf, cbz or images")
+	flag.StringVar(&sessionFile, "session-file", defaultSessionFile(), "Path to cache the auth token (empty disables caching)")
+	flag.BoolVar(&logout, "logout", false, "Delete the cached session token and exit")
 
 	flag.Parse()
 
+	if concurrency < 1 {
+		log.Fatalf("-concurrency must be at least 1, got %d", concurrency)
+	}
+
+	if logout {
+		if sessionFile == "" {
+			log.Fatal("no -session-file configured")
+		}
+
+		if err := deleteSessionCache(sessionFile); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Info("logged out")
+		return
+	}
+
 	if login == "" {
 		login = os.Getenv("ZINIO_EMAIL")
 	}
@@ -231,23 +390,93 @@ func main() {
 		os.Exit(1)
 	}
 
-	ctx := context.Background()
+	filters := Filters{
+		Magazine: magazine,
+		Issue:    issue,
+		Tags:     tags,
+		NoTags:   noTags,
+		Limit:    limit,
+		DryRun:   dryRun,
+	}
 
-	log.WithField("user", login).Info("logging in")
-	session, err := Login(ctx, login, password)
+	if since != "" {
+		sinceTime, err := time.Parse("2006-01-02", since)
 
-	if err != nil {
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "invalid -since date"))
+		}
+
+		filters.Since = sinceTime
+	}
+
+	// Cancelling ctx on Ctrl-C lets every in-flight fetch unwind through
+	// its own context.Context plumbing instead of the process just dying
+	// mid-download.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	config := SessionConfig{APIHost: apiHost}
+
+	session, magazines := loadCachedSession(ctx, config, sessionFile)
+
+	if session == nil {
+		log.WithField("user", login).Info("logging in")
+		s, err := LoginWithConfig(ctx, config, login, password)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		session = s
+
+		if sessionFile != "" {
+			if err := saveSessionCache(sessionFile, session.cache()); err != nil {
+				log.Error(errors.Wrap(err, "failed to save session cache"))
+			}
+		}
+
+		log.Info("downloading list of all magazines")
+		m, err := session.GetMagazines(ctx)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		magazines = m
+	}
+
+	if err := downloadAllIssues(ctx, session, magazines, concurrency, filters, OutputFormat(outputFormat)); err != nil {
 		log.Fatal(err)
 	}
+}
+
+// loadCachedSession tries to reuse the token cached at sessionFile,
+// validating it with a cheap GetMagazines call. It returns a nil session
+// if there is no usable cache, leaving the caller to fall back to Login.
+func loadCachedSession(ctx context.Context, config SessionConfig, sessionFile string) (*Session, []Magazine) {
+	if sessionFile == "" {
+		return nil, nil
+	}
+
+	cache, err := loadSessionCache(sessionFile)
+
+	if err != nil || cache.expired() {
+		return nil, nil
+	}
+
+	log.Info("using cached session")
+	session := sessionFromCache(config, *cache)
 
-	log.Info("downloading list of all magazines")
 	magazines, err := session.GetMagazines(ctx)
 
 	if err != nil {
-		log.Fatal(err)
-	}
+		if !isAuthError(err) {
+			log.Error(errors.Wrap(err, "failed to validate cached session"))
+		}
 
-	if err = downloadAllIssues(ctx, session, magazines); err != nil {
-		log.Fatal(err)
+		log.Info("cached session is no longer valid, logging in again")
+		return nil, nil
 	}
+
+	return session, magazines
 }
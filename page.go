@@ -0,0 +1,20 @@
+package main
+
+import "io"
+
+// page wraps the raw, still-encrypted bytes of a single downloaded page so
+// it can be handed straight to pdf.NewPdfReader. When backed by a page
+// cache file rather than an in-memory buffer, close releases the
+// underlying file handle.
+type page struct {
+	io.ReadSeeker
+	close func() error
+}
+
+func (p page) Close() error {
+	if p.close == nil {
+		return nil
+	}
+
+	return p.close()
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// defaultAPIHost is used when neither -api-host nor ZINIO_API_HOST is set.
+const defaultAPIHost = "api-sec.ziniopro.com"
+
+// SessionConfig controls how a Session talks to the Zinio API: which host
+// to hit, and which *http.Client to use for every request it makes so
+// callers can plug in a proxy, a rate-limited transport, or a recording
+// transport for tests.
+type SessionConfig struct {
+	APIHost string
+	Client  *http.Client
+}
+
+func (c SessionConfig) withDefaults() SessionConfig {
+	if c.APIHost == "" {
+		c.APIHost = apiHostFromEnv()
+	}
+
+	if c.Client == nil {
+		c.Client = http.DefaultClient
+	}
+
+	return c
+}
+
+func apiHostFromEnv() string {
+	if host := os.Getenv("ZINIO_API_HOST"); host != "" {
+		return host
+	}
+
+	return defaultAPIHost
+}
+
+// Session represents an authenticated Zinio account.
+type Session struct {
+	config       SessionConfig
+	token        string
+	refreshToken string
+	expiry       time.Time
+}
+
+// authError marks a request failure as an authentication problem (a 401),
+// as opposed to any other API or network error, so callers can tell
+// whether re-logging in is likely to help.
+type authError struct {
+	error
+}
+
+func isAuthError(err error) bool {
+	_, ok := errors.Cause(err).(authError)
+	return ok
+}
+
+// Login authenticates against the Zinio API host named by $ZINIO_API_HOST,
+// or defaultAPIHost if that is unset, using http.DefaultClient. Use
+// LoginWithConfig to point at a different host or inject a custom client.
+func Login(ctx context.Context, email, password string) (*Session, error) {
+	return LoginWithConfig(ctx, SessionConfig{}, email, password)
+}
+
+// LoginWithConfig authenticates against the Zinio API described by config.
+func LoginWithConfig(ctx context.Context, config SessionConfig, email, password string) (*Session, error) {
+	config = config.withDefaults()
+
+	body, err := json.Marshal(struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}{email, password})
+
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "https://"+config.APIHost+"/auth/login", bytes.NewReader(body))
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ctxhttp.Do(ctx, config.Client, req)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to log in")
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("login failed with status %s", resp.Status)
+	}
+
+	var result struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refreshToken"`
+		ExpiresIn    int    `json:"expiresInSeconds"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, errors.Wrap(err, "failed to decode login response")
+	}
+
+	session := &Session{config: config, token: result.Token, refreshToken: result.RefreshToken}
+
+	if result.ExpiresIn > 0 {
+		session.expiry = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	}
+
+	return session, nil
+}
+
+// sessionFromCache rebuilds a Session from a previously cached token
+// without hitting the login endpoint. The caller is expected to validate
+// the token (e.g. with a GetMagazines call) before relying on it.
+// cache.APIHost is only used as a fallback when the caller didn't already
+// ask for a specific host via -api-host or $ZINIO_API_HOST, so an explicit
+// override still takes effect on every run, not just the first login.
+func sessionFromCache(config SessionConfig, cache sessionCache) *Session {
+	explicitHost := config.APIHost != "" || os.Getenv("ZINIO_API_HOST") != ""
+	config = config.withDefaults()
+
+	if !explicitHost && cache.APIHost != "" {
+		config.APIHost = cache.APIHost
+	}
+
+	return &Session{
+		config:       config,
+		token:        cache.Token,
+		refreshToken: cache.RefreshToken,
+		expiry:       cache.Expiry,
+	}
+}
+
+// cache returns the on-disk representation of s, ready to be written by
+// saveSessionCache.
+func (s *Session) cache() sessionCache {
+	return sessionCache{
+		APIHost:      s.config.APIHost,
+		Token:        s.token,
+		RefreshToken: s.refreshToken,
+		Expiry:       s.expiry,
+	}
+}
+
+func (s *Session) get(ctx context.Context, path string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, "https://"+s.config.APIHost+path, nil)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+s.token)
+
+	resp, err := ctxhttp.Do(ctx, s.config.Client, req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return authError{errors.Errorf("request to %s failed with status %s", path, resp.Status)}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("request to %s failed with status %s", path, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// GetMagazines returns every magazine in the account's library, along with
+// the lightweight issue list for each.
+func (s *Session) GetMagazines(ctx context.Context) ([]Magazine, error) {
+	var magazines []Magazine
+
+	if err := s.get(ctx, "/library/magazines", &magazines); err != nil {
+		return nil, errors.Wrap(err, "failed to get magazines")
+	}
+
+	return magazines, nil
+}
+
+// GetIssue fetches the full metadata for a single issue, including its page
+// URLs and unlock password.
+func (s *Session) GetIssue(ctx context.Context, magazineID, issueID string) (*Issue, error) {
+	var issue Issue
+
+	if err := s.get(ctx, fmt.Sprintf("/library/magazines/%s/issues/%s", magazineID, issueID), &issue); err != nil {
+		return nil, errors.Wrap(err, "failed to get issue")
+	}
+
+	return &issue, nil
+}
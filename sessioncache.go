@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultSessionFileName = "session.json"
+
+// sessionCache is the on-disk representation of a Session's auth token,
+// written after a successful login so future runs can skip it.
+type sessionCache struct {
+	APIHost      string    `json:"apiHost"`
+	Token        string    `json:"token"`
+	RefreshToken string    `json:"refreshToken,omitempty"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+// expired reports whether the cache's token is known to be past its
+// expiry. A cache with no expiry set is never considered expired here;
+// it is up to the caller to validate it with a live request.
+func (c sessionCache) expired() bool {
+	return !c.Expiry.IsZero() && !time.Now().Before(c.Expiry)
+}
+
+// defaultSessionFile returns ~/.config/zinio/session.json, the default
+// -session-file location. It returns "" if the home directory can't be
+// determined, which disables caching.
+func defaultSessionFile() string {
+	home, err := os.UserHomeDir()
+
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".config", "zinio", defaultSessionFileName)
+}
+
+func loadSessionCache(path string) (*sessionCache, error) {
+	b, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var cache sessionCache
+
+	if err := json.Unmarshal(b, &cache); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse session cache %s", path)
+	}
+
+	return &cache, nil
+}
+
+// saveSessionCache writes cache to path with 0600 permissions, creating
+// its parent directory if needed.
+func saveSessionCache(path string, cache sessionCache) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrapf(err, "failed to create %s", filepath.Dir(path))
+	}
+
+	b, err := json.Marshal(cache)
+
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrapf(os.WriteFile(path, b, 0600), "failed to write session cache %s", path)
+}
+
+// deleteSessionCache removes the cached session at path, backing -logout.
+// It is not an error for the file to already be gone.
+func deleteSessionCache(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove session cache %s", path)
+	}
+
+	return nil
+}